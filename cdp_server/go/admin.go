@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// #region 统计计数器，供 GET /stats 使用
+
+var (
+	stat_forwarded       atomic.Int64
+	stat_dropped         atomic.Int64
+	stat_intercepted     atomic.Int64
+	stat_debugger_paused atomic.Int64
+)
+
+// #endregion
+
+// #region 流量旁路（/tap/{path}）
+
+// tapRecord 是 /tap/{path} 推送给订阅者的一条记录
+type tapRecord struct {
+	Dir string `json:"dir"`
+	Ts  int64  `json:"ts"`
+	Msg string `json:"msg"`
+}
+
+// taps 管理某一对连接的 /tap 订阅者，零值可用
+type taps struct {
+	m    sync.Mutex
+	subs map[chan tapRecord]struct{}
+}
+
+func (t *taps) subscribe() chan tapRecord {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.subs == nil {
+		t.subs = make(map[chan tapRecord]struct{})
+	}
+	ch := make(chan tapRecord, 256)
+	t.subs[ch] = struct{}{}
+	return ch
+}
+
+func (t *taps) unsubscribe(ch chan tapRecord) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.subs, ch)
+	close(ch)
+}
+
+// broadcast 把一条消息推给所有订阅者。订阅者消费太慢时直接丢弃，不能阻塞转发主流程
+func (t *taps) broadcast(dir string, msg []byte) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if len(t.subs) == 0 {
+		return
+	}
+	rec := tapRecord{Dir: dir, Ts: time.Now().UnixMilli(), Msg: string(msg)}
+	for ch := range t.subs {
+		select {
+		case ch <- rec:
+		default:
+			logger.Warn("tap subscriber too slow, dropping record")
+		}
+	}
+}
+
+// #endregion
+
+// #region admin HTTP API
+
+type connectionSummary struct {
+	Path          string `json:"path"`
+	RemoteAddr    string `json:"remoteAddr"`
+	BytesIn       int64  `json:"bytesIn"`
+	BytesOut      int64  `json:"bytesOut"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+// start_admin_server 启动一个独立的 HTTP 管理接口，暴露连接池的查看/控制能力，
+// 避免每次想看一眼状态或踢掉一个卡住的连接都要重启整个服务。
+func start_admin_server(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", admin_list_connections)
+	mux.HandleFunc("/connections/", admin_connection_by_path)
+	mux.HandleFunc("/stats", admin_stats)
+	mux.HandleFunc("/tap/", admin_tap)
+
+	logger.Info("admin API is running on " + addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("admin server failed: " + err.Error())
+		}
+	}()
+}
+
+func admin_list_connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := pool_list()
+	summaries := make([]connectionSummary, 0, len(list))
+	for _, pair := range list {
+		summaries = append(summaries, connectionSummary{
+			Path:          pair.Path,
+			RemoteAddr:    pair.RemoteAddr,
+			BytesIn:       pair.BytesIn.Load(),
+			BytesOut:      pair.BytesOut.Load(),
+			UptimeSeconds: int64(time.Since(pair.StartedAt).Seconds()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
+// DELETE /connections/{path} 强制关闭一对卡住的连接，这样新的 devtools 才能重新连上同一个 target
+func admin_connection_by_path(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/connections")
+	if path == "" || path == "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pair := pool_get(path)
+	if pair == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	devtools, web := pair.Endpoints()
+	if devtools != nil {
+		devtools.Close()
+	}
+	if web != nil {
+		web.Close()
+	}
+
+	logger.Warn("admin API force-closed connection for " + path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /stats 输出 Prometheus 文本格式的计数器
+func admin_stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP cdp_server_messages_forwarded_total Total CDP messages forwarded")
+	fmt.Fprintln(w, "# TYPE cdp_server_messages_forwarded_total counter")
+	fmt.Fprintf(w, "cdp_server_messages_forwarded_total %d\n", stat_forwarded.Load())
+
+	fmt.Fprintln(w, "# HELP cdp_server_messages_dropped_total Total CDP messages dropped instead of forwarded")
+	fmt.Fprintln(w, "# TYPE cdp_server_messages_dropped_total counter")
+	fmt.Fprintf(w, "cdp_server_messages_dropped_total %d\n", stat_dropped.Load())
+
+	fmt.Fprintln(w, "# HELP cdp_server_messages_intercepted_total Total CDP messages matched by a rule engine rule")
+	fmt.Fprintln(w, "# TYPE cdp_server_messages_intercepted_total counter")
+	fmt.Fprintf(w, "cdp_server_messages_intercepted_total %d\n", stat_intercepted.Load())
+
+	fmt.Fprintln(w, "# HELP cdp_server_debugger_paused_handled_total Total Debugger.paused events handled automatically")
+	fmt.Fprintln(w, "# TYPE cdp_server_debugger_paused_handled_total counter")
+	fmt.Fprintf(w, "cdp_server_debugger_paused_handled_total %d\n", stat_debugger_paused.Load())
+
+	fmt.Fprintln(w, "# HELP cdp_server_connections Current number of active target connections")
+	fmt.Fprintln(w, "# TYPE cdp_server_connections gauge")
+	fmt.Fprintf(w, "cdp_server_connections %d\n", len(pool_list()))
+}
+
+// GET /tap/{path} 升级为 WebSocket，实时推送该 target 双向流量的副本
+func admin_tap(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tap")
+	pair := pool_get(path)
+	if pair == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("tap upgrade failed: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ch := pair.taps.subscribe()
+	defer pair.taps.unsubscribe(ch)
+
+	// 读取客户端消息只是为了能检测到它主动断开连接（包括没发关闭帧、直接掉线
+	// 的情况）。检测到之后关闭 done，好让下面的写循环也能退出 —— 否则在一个
+	// 安静的 target 上，写循环会一直阻塞在 ch 上收不到任何东西，goroutine、
+	// 底层 socket 和 taps.subs 里的订阅都会被永远泄漏。
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case rec, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// #endregion
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// #region target 发现代理（/json 系列接口）
+
+// Chrome DevTools 通常会请求 http://host:port/json 来列出可调试的 target，
+// 然后从返回结果里挑一个 webSocketDebuggerUrl 去连接。
+//
+// 这里把这几个接口反向代理到真正的浏览器（localhost:WEB_SOCKET_PORT），
+// 并把返回内容里所有指向浏览器的 webSocketDebuggerUrl / devtoolsFrontendUrl
+// 改写成指向 CDP Server 自己的 host:port，这样只要把 DevTools（或 Puppeteer/
+// Playwright）指向 CDP Server，后续所有的 target 发现与 WS 连接都会自动走
+// 这里的拦截器，不需要手动改 URL。
+//
+// 和本文件其它地方的约定一致：不对响应内容做 JSON 解析，只做字符串替换。
+func register_discovery_handlers() {
+	http.HandleFunc("/json", discovery_proxy_handler)
+	http.HandleFunc("/json/version", discovery_proxy_handler)
+	http.HandleFunc("/json/list", discovery_proxy_handler)
+	http.HandleFunc("/json/new", discovery_proxy_handler)
+}
+
+func discovery_proxy_handler(w http.ResponseWriter, r *http.Request) {
+	target := fmt.Sprintf("http://localhost:%d%s", WEB_SOCKET_PORT, r.URL.Path)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(r.Method, target, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("discovery proxy: request to browser failed: " + err.Error())
+		http.Error(w, "failed to reach browser remote debug endpoint", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	body = rewrite_discovery_urls(body, r.Host)
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+// rewrite_discovery_urls 把 body 中所有 "localhost:WEB_SOCKET_PORT" 替换成
+// cdp_host（即客户端实际用来访问 CDP Server 的 host:port），
+// 这样 webSocketDebuggerUrl 和 devtoolsFrontendUrl 里出现的两种形式
+// （ws://localhost:PORT/... 以及 ?ws=localhost:PORT/...）都能被替换到。
+func rewrite_discovery_urls(body []byte, cdp_host string) []byte {
+	old_host := []byte(fmt.Sprintf("localhost:%d", WEB_SOCKET_PORT))
+	new_host := []byte(cdp_host)
+	return bytes.ReplaceAll(body, old_host, new_host)
+}
+
+// #endregion
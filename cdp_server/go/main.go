@@ -13,6 +13,8 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -36,6 +38,15 @@ var (
 	// 浏览器远程调试的地址，需要指定浏览器远程调试端口。
 	// 其形如 localhost:9222/devtools/page/{websocket_id}
 	WEB_SOCKET_DEBUG_API string
+
+	// 发送 ping 的间隔，必须小于 pongWait
+	pingPeriod time.Duration
+
+	// 等待 pong（或任意读操作）的超时时间，超时则认为连接已经死掉
+	pongWait time.Duration
+
+	// 允许读取的单条消息的最大字节数
+	maxMessageSize int64
 )
 
 // #endregion
@@ -59,7 +70,14 @@ type DebuggerPaused struct {
 
 // #region 定义自己的类型
 
-const buffer_size = 1024 * 1024
+// 每个连接的发送/接收队列大小。之前这里是 1024*1024，对一个喜欢刷屏的 target
+// （比如密集的 Network.dataReceived）配一个很慢的 DevTools 客户端，会在队列里
+// 攒下几十 MB 甚至几 GB 的待发消息。改成一个小的有界队列，配合下面 WriteMessage
+// 里的高水位检测，让慢客户端尽快暴露出来，而不是把内存堆爆。
+const queue_size = 256
+
+// 队列深度超过该值时认为对端消费过慢，直接断开连接（见 WriteMessage）
+const queue_high_water_mark = queue_size * 3 / 4
 
 // 为了解决 panic: concurrent write to websocket connection 问题。
 //
@@ -84,17 +102,30 @@ const buffer_size = 1024 * 1024
 // Connections support one concurrent reader and one concurrent writer.
 // Applications are responsible for ensuring that no more than one goroutine calls the write methods (NextWriter, SetWriteDeadline, WriteMessage, WriteJSON, EnableWriteCompression, SetCompressionLevel) concurrently and that no more than one goroutine calls the read methods (NextReader, SetReadDeadline, ReadMessage, ReadJSON, SetPongHandler, SetPingHandler) concurrently.
 // The Close and WriteControl methods can be called concurrently with all other methods.
+
+// 表示一帧 WebSocket 消息，保留原始的消息类型（TextMessage / BinaryMessage），
+// 这样二进制的 CDP 负载（例如以二进制方式传输的 Page.captureScreenshot 结果）
+// 才不会在转发过程中被破坏或被错误地当成文本处理。
+type WSMessage struct {
+	Type int
+	Data []byte
+}
+
 type MyWSConnection struct {
 	// 该连接的名称，用于日志输出
 	Name string
 	// WebSocket 连接
 	conn *websocket.Conn
-	// 通过该通道指定要 Conn 发送的数据，默认缓冲大小是常量 buffer_size 的值
-	msg_sender chan []byte
-	// 通过该通道接收 Conn 发送的数据，默认缓冲大小是常量 buffer_size 的值
-	msg_reciver chan []byte
+	// 通过该通道指定要 Conn 发送的数据，默认缓冲大小是常量 queue_size 的值
+	msg_sender chan WSMessage
+	// 通过该通道接收 Conn 发送的数据，默认缓冲大小是常量 queue_size 的值
+	msg_reciver chan WSMessage
 	// 连接是否关闭
 	is_closed bool
+	// 在 Close() 中关闭，用来唤醒所有阻塞在 msg_sender/msg_reciver 上的协程。
+	// 注意 msg_sender/msg_reciver 本身不会被关闭 —— 否则其它协程仍在往里面
+	// 发送数据时就会 panic: send on closed channel。
+	done chan struct{}
 	// 互斥量，因为多个协程会访问 is_closed
 	m sync.Mutex
 }
@@ -103,15 +134,44 @@ func NewMyWSConnection(name string, conn *websocket.Conn) *MyWSConnection {
 	c := &MyWSConnection{
 		Name:        name,
 		conn:        conn,
-		msg_sender:  make(chan []byte, buffer_size),
-		msg_reciver: make(chan []byte, buffer_size),
+		msg_sender:  make(chan WSMessage, queue_size),
+		msg_reciver: make(chan WSMessage, queue_size),
 		is_closed:   false,
+		done:        make(chan struct{}),
 		m:           sync.Mutex{},
 	}
 
 	return c
 }
 
+// 启动心跳：设置读取限制、首个读超时，并在收到 pong 时延长超时时间。
+// 必须在 start() 之前调用，这样第一次 ReadMessage 就受超时保护。
+func (c *MyWSConnection) setup_keepalive() {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// 定时发送 ping，保活连接；对端长时间不回应 pong（即 ReadMessage 超时）就会触发关闭。
+//
+// WriteControl 可以和 WriteMessage 并发调用，所以不需要经过 msg_sender 通道。
+func (c *MyWSConnection) start_keepalive_ping() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if c.is_Closed() {
+			return
+		}
+		if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongWait)); err != nil {
+			logger.Error(c.Name + " send ping failed: " + err.Error())
+			return
+		}
+	}
+}
+
 // 是多线程安全的
 func (c *MyWSConnection) is_Closed() bool {
 	c.m.Lock()
@@ -127,50 +187,89 @@ func (c *MyWSConnection) is_Closed() bool {
 func (c *MyWSConnection) start() {
 	defer c.Close()
 
+	c.setup_keepalive()
+	go c.start_keepalive_ping()
+
 	// 从 socket 读取数据似乎会阻塞，只好单独拿出去执行了
 	go func() {
 		defer c.Close()
 		for {
-			_, msg, err := c.conn.ReadMessage()
+			mt, msg, err := c.conn.ReadMessage()
 			if err != nil {
 				logger.Error(c.Name + " ReadMessage failed: " + err.Error())
 				return
 			}
-			if c.is_Closed() {
+			if !c.push_reciver(WSMessage{Type: mt, Data: msg}) {
+				// 连接已经关闭，或者对端迟迟不调用 ReadMessage 消费队列
 				return
-			} else {
-				c.msg_reciver <- msg
 			}
 		}
 	}()
 
-	for msg := range c.msg_sender {
-		if c.is_Closed() {
-			return
-		}
-		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-			logger.Error(c.Name + " WriteMessage failed: " + err.Error())
+	for {
+		select {
+		case <-c.done:
 			return
+		case frame := <-c.msg_sender:
+			if err := c.conn.WriteMessage(frame.Type, frame.Data); err != nil {
+				logger.Error(c.Name + " WriteMessage failed: " + err.Error())
+				return
+			}
 		}
 	}
 }
 
-// 可能阻塞，因为通道缓冲区满了
-func (c *MyWSConnection) WriteMessage(msg []byte) error {
+// 把读到的数据塞进 msg_reciver，遇到连接已关闭或者队列长期处于高水位
+// （说明消费者——也就是 ReadMessage 的调用方——太慢了）就不再塞，并关闭连接。
+// 返回 false 表示调用方应当停止继续读取。
+func (c *MyWSConnection) push_reciver(frame WSMessage) bool {
+	if len(c.msg_reciver) >= queue_high_water_mark {
+		logger.Warn(fmt.Sprintf("%s reciver queue stalled (depth=%d), closing with 1009", c.Name, len(c.msg_reciver)))
+		c.close_stalled()
+		return false
+	}
+	select {
+	case c.msg_reciver <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// 可能阻塞（直到成功发送、连接关闭，或者因为对端消费过慢被强制关闭）
+func (c *MyWSConnection) WriteMessage(mt int, msg []byte) error {
 	if c.is_Closed() {
 		return fmt.Errorf("%s connection closed", c.Name)
 	}
-	c.msg_sender <- msg
-	return nil
+	if len(c.msg_sender) >= queue_high_water_mark {
+		logger.Warn(fmt.Sprintf("%s sender queue stalled (depth=%d), closing with 1009", c.Name, len(c.msg_sender)))
+		c.close_stalled()
+		return fmt.Errorf("%s send queue stalled, connection closed", c.Name)
+	}
+	select {
+	case c.msg_sender <- WSMessage{Type: mt, Data: msg}:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("%s connection closed", c.Name)
+	}
 }
 
 // 可能阻塞，因为通道缓冲区是空的
-func (c *MyWSConnection) ReadMessage() (msg []byte, err error) {
-	if c.is_Closed() {
-		return nil, fmt.Errorf("%s connection closed", c.Name)
+func (c *MyWSConnection) ReadMessage() (mt int, msg []byte, err error) {
+	select {
+	case frame := <-c.msg_reciver:
+		return frame.Type, frame.Data, nil
+	case <-c.done:
+		return 0, nil, fmt.Errorf("%s connection closed", c.Name)
 	}
-	msg = <-c.msg_reciver
-	return msg, nil
+}
+
+// close_stalled 用 1009（消息过大/对端消费太慢）关闭连接，并记录是哪个方向卡住了
+func (c *MyWSConnection) close_stalled() {
+	deadline := time.Now().Add(time.Second)
+	msg := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "message queue too slow to drain")
+	c.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	c.Close()
 }
 
 func (c *MyWSConnection) Close() {
@@ -178,8 +277,7 @@ func (c *MyWSConnection) Close() {
 	defer c.m.Unlock()
 	if !c.is_closed {
 		logger.Warn(c.Name + " connection is closing")
-		close(c.msg_sender)
-		close(c.msg_reciver)
+		close(c.done)
 		c.is_closed = true
 	}
 	c.conn.Close()
@@ -195,12 +293,79 @@ type ConnectionInfo struct {
 // 存储一对连接。因为 devtools 和 web 端的连接是成对出现的，所以使用一个 map 来存储。
 // 并且后续会确保不会有 devtools 连接到同一个 web
 type DevtoolsToWebConnection struct {
+	// mu 保护 Devtools/Web 这两个字段：Web 在 websocket_handler 建立占位之后、
+	// start_transmiter_task 连上 web 端之前都是 nil，而 admin API 可能在这段
+	// 时间内并发地读取它们（比如 DELETE /connections/{path}）。
+	mu       sync.Mutex
 	Devtools *MyWSConnection
 	Web      *MyWSConnection
+
+	// 下面这些字段是给 admin API（见 admin.go）用的统计信息
+
+	// 该 target 的路径，即 CONNECTION_POOL 的 key
+	Path string
+	// devtools 端的远程地址
+	RemoteAddr string
+	// 这对连接建立的时间
+	StartedAt time.Time
+	// web -> devtools 方向转发的字节数
+	BytesIn atomic.Int64
+	// devtools -> web 方向转发的字节数
+	BytesOut atomic.Int64
+
+	// /tap/{path} 的订阅者，用于实时旁路双向流量
+	taps taps
+}
+
+// SetWeb 在 web 端连接建立后设置 Web 字段，和 Endpoints() 共用同一把锁
+func (p *DevtoolsToWebConnection) SetWeb(web *MyWSConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Web = web
+}
+
+// Endpoints 安全地读取 Devtools/Web 这对连接，Web 在建立之前可能为 nil
+func (p *DevtoolsToWebConnection) Endpoints() (devtools, web *MyWSConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Devtools, p.Web
 }
 
 type ConnectionPool map[string]*DevtoolsToWebConnection
 
+// pool_mu 保护对 CONNECTION_POOL 的并发读写：admin API 会在后台 goroutine 里
+// 遍历/查找它，而 websocket_handler/start_transmiter_task 会并发地写入它。
+var pool_mu sync.RWMutex
+
+func pool_get(path string) *DevtoolsToWebConnection {
+	pool_mu.RLock()
+	defer pool_mu.RUnlock()
+	return CONNECTION_POOL[path]
+}
+
+func pool_set(path string, pair *DevtoolsToWebConnection) {
+	pool_mu.Lock()
+	defer pool_mu.Unlock()
+	CONNECTION_POOL[path] = pair
+}
+
+func pool_delete(path string) {
+	pool_mu.Lock()
+	defer pool_mu.Unlock()
+	delete(CONNECTION_POOL, path)
+}
+
+// pool_list 返回当前连接池的一份快照，按 path 排序无关紧要，调用方自行处理
+func pool_list() []*DevtoolsToWebConnection {
+	pool_mu.RLock()
+	defer pool_mu.RUnlock()
+	list := make([]*DevtoolsToWebConnection, 0, len(CONNECTION_POOL))
+	for _, pair := range CONNECTION_POOL {
+		list = append(list, pair)
+	}
+	return list
+}
+
 // 记录已经连接的 target，避免重复连接 —— 多个 devtools 连接到同一个 web
 type ConnectedTarget map[string]bool
 
@@ -214,8 +379,12 @@ type ConnectedTarget map[string]bool
 - 如果返回 ([], false) 则表示不转发。
 
 之所以传入了 connection 是因为可能要进行拦截、并返回给 _from 那一端。
+
+mt 是该消息原始的 WebSocket 消息类型（TextMessage / BinaryMessage），
+字符串匹配等需要解析内容的逻辑只应在 mt 为 TextMessage 时进行，
+BinaryMessage 的帧应当被透明转发。
 */
-type TransimiterHandler = func(_from *MyWSConnection, cinfo *ConnectionInfo, msg []byte) (data []byte, is_ok bool)
+type TransimiterHandler = func(_from, _to *MyWSConnection, cinfo *ConnectionInfo, mt int, msg []byte) (data []byte, is_ok bool)
 
 // #endregion
 
@@ -231,6 +400,9 @@ var upgrader = websocket.Upgrader{
 
 var logger *slog.Logger
 
+// 规则引擎，可能为 nil（未通过 -rules 指定配置文件时不启用）
+var ruleEngine *RuleEngine
+
 //#endregion
 
 func main() {
@@ -240,15 +412,33 @@ func main() {
 	cdp := flag.Uint("cdp", 9221, "CDP Server port")
 	port := flag.Uint("port", 9222, "Broswer's remote debug port")
 	enable_log := flag.Bool("log", false, "Enable log, save to server.log file")
+	ping_period := flag.Duration("ping-period", 54*time.Second, "Interval between keepalive pings, must be less than -pong-wait")
+	pong_wait := flag.Duration("pong-wait", 60*time.Second, "How long to wait for a pong (or any read) before considering a connection dead")
+	max_message_size := flag.Int64("max-message-size", 1024*1024, "Maximum size in bytes of a single WebSocket message")
+	rules_path := flag.String("rules", "", "Path to a JSON or YAML rule config for CDP message interception (hot-reloadable via SIGHUP)")
+	admin_port := flag.Uint("admin", 0, "Admin API port, 0 disables it")
 
 	flag.Parse()
 	MYDEBUGGER_NAME = *debugger
 	CDP_SERVER_PORT = uint(*cdp)
 	WEB_SOCKET_PORT = uint(*port)
 	WEB_SOCKET_DEBUG_API = fmt.Sprintf("ws://localhost:%d/devtools/page", WEB_SOCKET_PORT)
+	if *ping_period <= 0 {
+		log.Fatal("-ping-period must be positive")
+	}
+	if *pong_wait <= 0 {
+		log.Fatal("-pong-wait must be positive")
+	}
+	if *ping_period >= *pong_wait {
+		log.Fatal("-ping-period must be less than -pong-wait")
+	}
+	pingPeriod = *ping_period
+	pongWait = *pong_wait
+	maxMessageSize = *max_message_size
 
 	// #endregion
 
+	register_discovery_handlers()
 	http.HandleFunc("/", websocket_handler)
 
 	m := fmt.Sprintf(`
@@ -264,6 +454,18 @@ My debugger is: %s
 	fmt.Println(m)
 	logger = init_logger(*enable_log)
 
+	if *rules_path != "" {
+		re, err := NewRuleEngine(*rules_path)
+		if err != nil {
+			log.Fatal("load rules failed: " + err.Error())
+		}
+		ruleEngine = re
+	}
+
+	if *admin_port != 0 {
+		start_admin_server(fmt.Sprintf(":%d", *admin_port))
+	}
+
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", CDP_SERVER_PORT), nil))
 }
 
@@ -293,7 +495,8 @@ func websocket_handler(w http.ResponseWriter, r *http.Request) {
 	logger.Info("=> devtools try to debug target: " + path)
 
 	// 避免多个 devtools 连接到同一个 web。必须手动关闭之前的那一个才行
-	if CONNECTION_POOL[path] != nil {
+	// （也可以通过 admin API 的 DELETE /connections/{path} 主动关闭）
+	if pool_get(path) != nil {
 		logger.Warn(path + " already connected")
 		return
 	}
@@ -303,6 +506,13 @@ func websocket_handler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal("upgrade websocket failed: " + err.Error())
 	}
 	devtools := NewMyWSConnection("devtools", ws)
+	// 占位，避免同一个 path 被多个 devtools 连接；真正的连接对象在建立 web 端连接后写入
+	pool_set(path, &DevtoolsToWebConnection{
+		Devtools:   devtools,
+		Path:       path,
+		RemoteAddr: r.RemoteAddr,
+		StartedAt:  time.Now(),
+	})
 	// 现在已经有了 devtools 端，可以开始连接 web 端，并进行任务
 	go start_transmiter_task(devtools, path)
 }
@@ -317,11 +527,16 @@ func start_transmiter_task(devtools *MyWSConnection, path string) {
 	ws, _, err := websocket.DefaultDialer.Dial(debug_url, nil)
 	if err != nil {
 		logger.Error("connect to web target failed: " + err.Error())
+		// 没有这一步的话，path 会一直占着 CONNECTION_POOL，之后任何 devtools
+		// 都无法重新连接到同一个 target，只能重启整个服务
+		pool_delete(path)
 		return
 	}
 	web := NewMyWSConnection("web", ws)
 	defer web.Close()
 
+	pool_get(path).SetWeb(web)
+
 	// 现在已经有了 devtools 与 web 两端，可以开始转发数据了
 	go devtools.start()
 	go web.start()
@@ -345,7 +560,7 @@ func start_transmiter_task(devtools *MyWSConnection, path string) {
 	wg.Wait()
 
 	// 清理资源
-	delete(CONNECTION_POOL, path)
+	pool_delete(path)
 	logger.Info("clear resource for debug target: " + path)
 }
 
@@ -358,9 +573,10 @@ func transimiter(_from, _to *MyWSConnection, cinfo *ConnectionInfo, handler *Tra
 	defer _from.Close()
 
 	info_prefix := fmt.Sprintf("[%s] %s", cinfo.cid, cinfo.des)
+	pair := pool_get(cinfo.cid)
 	// 从 web 端读取数据，并转发到 devtools 端
 	for {
-		message, err := _from.ReadMessage()
+		mt, message, err := _from.ReadMessage()
 		if err != nil {
 			logger.Error(info_prefix + ": failed: " + err.Error())
 			return
@@ -368,21 +584,54 @@ func transimiter(_from, _to *MyWSConnection, cinfo *ConnectionInfo, handler *Tra
 
 		logger.Debug(fmt.Sprintf("%s: %s\n", info_prefix, message))
 
+		if pair != nil {
+			pair.taps.broadcast(cinfo.des, message)
+		}
+
+		// 先交给规则引擎处理，命中 drop/rewrite/sendToPeer/sendToSource 规则时
+		// 不再调用下面硬编码的 handler
+		if ruleEngine != nil {
+			var drop, matched bool
+			message, drop, matched = ruleEngine.Apply(cinfo.des, _from, _to, mt, message)
+			if matched {
+				stat_intercepted.Add(1)
+			}
+			if drop {
+				stat_dropped.Add(1)
+				continue
+			}
+		}
+
 		is_ok := true // 为 true 表示继续转发
 		if handler != nil {
-			message, is_ok = (*handler)(_from, cinfo, message)
+			message, is_ok = (*handler)(_from, _to, cinfo, mt, message)
 		}
 		// 将数据转发到 devtools 端
 		if is_ok {
-			if err := _to.WriteMessage(message); err != nil {
+			if err := _to.WriteMessage(mt, message); err != nil {
 				logger.Error(info_prefix + " failed: " + err.Error())
 				return
 			}
+			stat_forwarded.Add(1)
+			if pair != nil {
+				if cinfo.des == "web -> devtools" {
+					pair.BytesIn.Add(int64(len(message)))
+				} else {
+					pair.BytesOut.Add(int64(len(message)))
+				}
+			}
+		} else {
+			stat_dropped.Add(1)
 		}
 	}
 }
 
-func handle_msg_from_devtools(_from *MyWSConnection, cinfo *ConnectionInfo, msg []byte) (data []byte, is_ok bool) {
+func handle_msg_from_devtools(_from, _to *MyWSConnection, cinfo *ConnectionInfo, mt int, msg []byte) (data []byte, is_ok bool) {
+	// 二进制帧（如二进制方式传输的截图负载）原样转发，不做字符串处理
+	if mt != websocket.TextMessage {
+		return msg, true
+	}
+
 	// easter egg ??? 嘿嘿
 	if temp_msg := string(msg); strings.Contains(temp_msg, "Overlay.setPausedInDebuggerMessage") {
 		msg = []byte(strings.Replace(temp_msg, "Paused in debugger", "Paused in debugger - Surprise "+Author, 1))
@@ -390,7 +639,12 @@ func handle_msg_from_devtools(_from *MyWSConnection, cinfo *ConnectionInfo, msg
 	return msg, true
 }
 
-func handle_msg_from_web(_from *MyWSConnection, cinfo *ConnectionInfo, msg []byte) (data []byte, is_ok bool) {
+func handle_msg_from_web(_from, _to *MyWSConnection, cinfo *ConnectionInfo, mt int, msg []byte) (data []byte, is_ok bool) {
+	// 二进制帧（如二进制方式传输的截图负载）原样转发，不做字符串处理
+	if mt != websocket.TextMessage {
+		return msg, true
+	}
+
 	info_prefix := fmt.Sprintf("[%s] %s", cinfo.cid, "web -> server")
 
 	// 忽略 id 为 0 的信息，那都是 cdp server 发出去的
@@ -418,13 +672,14 @@ func process_debugger_paused(_from *MyWSConnection, cinfo *ConnectionInfo, param
 	if !is_js_debugger {
 		return false
 	}
+	stat_debugger_paused.Add(1)
 	info_prefix := fmt.Sprintf("[%s] %s", cinfo.cid, "web -> server")
 	// 是否为自定义的断点
 	is_my_debugger := (params.CallFrames[0].FunctionName == MYDEBUGGER_NAME)
 	if is_my_debugger {
 		logger.Warn(fmt.Sprintf("[%s] debugger paused in my debugger {%s}", info_prefix, MYDEBUGGER_NAME))
 		t := []byte(`{"id":0,"method":"Debugger.stepOut","params":{}}`)
-		if err := _from.WriteMessage(t); err != nil {
+		if err := _from.WriteMessage(websocket.TextMessage, t); err != nil {
 			logger.Error("server send <Debugger.stepOut> message faild: " + err.Error())
 			return false // 发送失败就转发好了
 		}
@@ -433,7 +688,7 @@ func process_debugger_paused(_from *MyWSConnection, cinfo *ConnectionInfo, param
 	} else {
 		// 不进行 JSON 处理，直接构建字符串发送
 		t := []byte(`{"id":0,"method":"Debugger.resume","params":{"terminateOnResume":false}}`)
-		if err := _from.WriteMessage(t); err != nil {
+		if err := _from.WriteMessage(websocket.TextMessage, t); err != nil {
 			logger.Error("server send <Debugger.resume> message faild: " + err.Error())
 			return false // 发送失败就转发好了
 		}
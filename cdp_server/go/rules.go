@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// #region 规则匹配与动作
+
+// 规则的匹配条件，对应一条转发中的消息。
+type RuleMatch struct {
+	// 转发方向，例如 "web->devtools" 或 "devtools->web"。
+	// 比较时会去掉空格，所以日志里 "web -> devtools" 这种写法也能匹配。
+	Direction string `json:"direction" yaml:"direction"`
+	// CDP 方法名，例如 "Debugger.paused"，为空表示不限制
+	Method string `json:"method" yaml:"method"`
+	// Debugger.paused 的 params.reason 相等匹配，为空表示不限制
+	ReasonEq string `json:"reasonEq" yaml:"reasonEq"`
+	// 对第一个 call frame 的 functionName 做正则匹配，为空表示不限制
+	CallFrameRegex string `json:"callFrameRegex" yaml:"callFrameRegex"`
+
+	callFrameRe *regexp.Regexp
+}
+
+// 一条规则：匹配条件 + 命中后的动作。
+type Rule struct {
+	Match RuleMatch `json:"match" yaml:"match"`
+
+	// 动作：drop、forward、rewrite、sendToPeer、sendToSource
+	Action string `json:"action" yaml:"action"`
+	// sendToPeer / sendToSource 动作发送的消息内容
+	Payload string `json:"payload" yaml:"payload"`
+	// rewrite 动作使用的正则，匹配到的内容会被替换为 Payload
+	RewriteRegex string `json:"rewriteRegex" yaml:"rewriteRegex"`
+
+	rewriteRe *regexp.Regexp
+}
+
+// 用于从消息中提取匹配所需字段的信封，复用 DebuggerPausedParams 的结构
+type ruleMatchEnvelope struct {
+	Method string               `json:"method"`
+	Params DebuggerPausedParams `json:"params"`
+}
+
+func (r *Rule) compile() error {
+	if r.Match.CallFrameRegex != "" {
+		re, err := regexp.Compile(r.Match.CallFrameRegex)
+		if err != nil {
+			return fmt.Errorf("invalid callFrameRegex %q: %w", r.Match.CallFrameRegex, err)
+		}
+		r.Match.callFrameRe = re
+	}
+	if r.Action == "rewrite" {
+		if r.RewriteRegex == "" {
+			return fmt.Errorf("rewrite rule must set rewriteRegex")
+		}
+		re, err := regexp.Compile(r.RewriteRegex)
+		if err != nil {
+			return fmt.Errorf("invalid rewriteRegex %q: %w", r.RewriteRegex, err)
+		}
+		r.rewriteRe = re
+	}
+	return nil
+}
+
+// 判断该规则是否匹配给定的消息，direction 形如 "web -> devtools"
+func (r *Rule) matches(direction string, mt int, msg []byte) bool {
+	if r.Match.Direction != "" && strings.ReplaceAll(r.Match.Direction, " ", "") != strings.ReplaceAll(direction, " ", "") {
+		return false
+	}
+	// 规则目前只针对文本帧（CDP 协议消息）生效，二进制帧一律透传
+	if mt != websocket.TextMessage {
+		return false
+	}
+
+	if r.Match.Method == "" && r.Match.ReasonEq == "" && r.Match.callFrameRe == nil {
+		return true
+	}
+
+	var env ruleMatchEnvelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return false
+	}
+	if r.Match.Method != "" && env.Method != r.Match.Method {
+		return false
+	}
+	if r.Match.ReasonEq != "" && env.Params.Reason != r.Match.ReasonEq {
+		return false
+	}
+	if r.Match.callFrameRe != nil {
+		if len(env.Params.CallFrames) == 0 || !r.Match.callFrameRe.MatchString(env.Params.CallFrames[0].FunctionName) {
+			return false
+		}
+	}
+	return true
+}
+
+// #endregion
+
+// #region 规则引擎
+
+// RuleEngine 按顺序保存一组规则，在收到 SIGHUP 时可以重新加载配置文件，
+// 从而在不重新编译、甚至不重启进程的情况下增加新的拦截规则。
+type RuleEngine struct {
+	path string
+
+	m     sync.RWMutex
+	rules []Rule
+}
+
+// NewRuleEngine 加载 path 指定的规则配置（JSON 或 YAML，按扩展名区分），
+// 并注册 SIGHUP 信号用于热重载。
+func NewRuleEngine(path string) (*RuleEngine, error) {
+	re := &RuleEngine{path: path}
+	if err := re.Reload(); err != nil {
+		return nil, err
+	}
+	re.watch_sighup()
+	return re, nil
+}
+
+func load_rules_file(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("parse yaml rules: %w", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("parse json rules: %w", err)
+		}
+	}
+
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// Reload 重新读取并编译配置文件中的规则，原子地替换当前生效的规则列表。
+// 解析失败时保留旧规则不变，只记录错误。
+func (re *RuleEngine) Reload() error {
+	rules, err := load_rules_file(re.path)
+	if err != nil {
+		if logger != nil {
+			logger.Error("rule engine reload failed, keep old rules: " + err.Error())
+		}
+		return err
+	}
+
+	re.m.Lock()
+	re.rules = rules
+	re.m.Unlock()
+
+	if logger != nil {
+		logger.Info(fmt.Sprintf("rule engine loaded %d rule(s) from %s", len(rules), re.path))
+	}
+	return nil
+}
+
+func (re *RuleEngine) watch_sighup() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			logger.Info("received SIGHUP, reloading rules from " + re.path)
+			re.Reload()
+		}
+	}()
+}
+
+// Apply 依次用 rules 尝试匹配消息，命中第一条规则就执行其动作并返回。
+//
+// - drop：消息被丢弃，不转发给 _to，也不再交给后续的 handler 处理。
+//
+// - forward：等同于没有命中规则，正常走后续流程。
+//
+// - rewrite：按 RewriteRegex/Payload 改写消息内容，再继续正常流程转发。
+//
+// - sendToPeer：直接把 Payload 发送给 _to（转发方向的对端），丢弃原消息。
+//
+// - sendToSource：把 Payload 发回给 _from（消息的发送者），丢弃原消息。
+//
+// 返回的 data 是（可能被改写过的）消息；drop 为 true 表示不需要再转发或调用 handler；
+// matched 为 true 表示有规则命中（即使该规则的动作是 forward）。
+func (re *RuleEngine) Apply(direction string, _from, _to *MyWSConnection, mt int, msg []byte) (data []byte, drop bool, matched bool) {
+	re.m.RLock()
+	rules := re.rules
+	re.m.RUnlock()
+
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(direction, mt, msg) {
+			continue
+		}
+
+		switch r.Action {
+		case "drop":
+			return nil, true, true
+		case "forward", "":
+			return msg, false, true
+		case "rewrite":
+			return r.rewriteRe.ReplaceAll(msg, []byte(r.Payload)), false, true
+		case "sendToPeer":
+			if err := _to.WriteMessage(mt, []byte(r.Payload)); err != nil {
+				logger.Error("rule engine sendToPeer failed: " + err.Error())
+			}
+			return nil, true, true
+		case "sendToSource":
+			if err := _from.WriteMessage(mt, []byte(r.Payload)); err != nil {
+				logger.Error("rule engine sendToSource failed: " + err.Error())
+			}
+			return nil, true, true
+		default:
+			logger.Warn("rule engine: unknown action " + r.Action)
+			return msg, false, true
+		}
+	}
+
+	return msg, false, false
+}
+
+// #endregion